@@ -0,0 +1,422 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright 2026 Joel Rosdahl
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// reapiDigest is a Remote Execution API v2 digest: a SHA-256 hash and the
+// size in bytes of the content it identifies.
+type reapiDigest struct {
+	hash      string
+	sizeBytes int64
+}
+
+// keyDigest derives the digest used to address a cache key under
+// bazel-kind=ac. Action cache entries aren't content-addressed: the key is
+// an opaque handle chosen by ccache, so hashing it just gives every key a
+// fixed-length, REAPI-shaped address.
+func keyDigest(key []byte) reapiDigest {
+	sum := sha256.Sum256(key)
+	return reapiDigest{hash: hex.EncodeToString(sum[:]), sizeBytes: int64(len(key))}
+}
+
+// casKeyDigest treats key as if it already were the hex of a REAPI digest,
+// for bazel-kind=cas's get and remove: unlike put and putStream (see
+// bazelPut), which have the value available and so always address by its
+// real SHA-256 (see contentDigest), get and remove only ever have key, and
+// ccache's own IPC protocol never supplies a content digest there, only its
+// own opaque cache key. So this is a best effort, not a correct REAPI CAS
+// lookup: plain ccache's key is essentially never sha256(value), and a GET
+// or DELETE addressed this way will generally not find what a previous PUT
+// of the same key actually wrote. It only does the right thing for a caller
+// that independently knows and passes the real content digest as key.
+func casKeyDigest(key []byte) reapiDigest {
+	return reapiDigest{hash: hex.EncodeToString(key)}
+}
+
+// contentDigest computes the real REAPI digest of data, i.e. the digest a
+// Remote Execution CAS would use to address it.
+func contentDigest(data []byte) reapiDigest {
+	sum := sha256.Sum256(data)
+	return reapiDigest{hash: hex.EncodeToString(sum[:]), sizeBytes: int64(len(data))}
+}
+
+// addressDigest returns the digest used to address key under kind, for the
+// get and remove paths where only key (never value) is available: ac
+// addresses by hashing the opaque key (see keyDigest), and cas falls back
+// to treating key as if it already were the digest (see casKeyDigest),
+// which is only correct for a caller that supplies real content digests.
+func addressDigest(kind string, key []byte) reapiDigest {
+	if kind == "cas" {
+		return casKeyDigest(key)
+	}
+	return keyDigest(key)
+}
+
+// bazelPath returns the path ac/{hex} or cas/{hex} that a request for d is
+// read from and written to.
+func bazelPath(kind string, d reapiDigest) string {
+	return fmt.Sprintf("%s/%s", kind, d.hash)
+}
+
+// bazelGet implements get for the "bazel" layout: a GET against ac/{hex}
+// or cas/{hex}, where {hex} is derived from the key (see addressDigest).
+// For bazel-kind=cas, the body is verified against the requested digest
+// after download; a mismatch is reported as a cache miss rather than an
+// error, so the caller just recomputes instead of failing the build. Note
+// that addressDigest can't derive a real content digest from key alone
+// (see casKeyDigest), so against a real CAS server this verification will
+// usually turn up a mismatch (miss) rather than a hit, for any value
+// originally stored by bazelPut/bazelPutStream under the same ccache key.
+func (s *storageClient) bazelGet(ctx context.Context, key []byte) ([]byte, bool, error) {
+	d := addressDigest(s.bazelKind, key)
+	urlStr, err := s.buildURLForPath(bazelPath(s.bazelKind, d))
+	if err != nil {
+		return nil, false, err
+	}
+
+	var value []byte
+	var found bool
+	err = s.retry(ctx, "GET (bazel)", s.retries, func(attemptNum int) (bool, time.Duration, error) {
+		s.logger.logf("GET (bazel) %s", urlStr)
+		req, err := http.NewRequestWithContext(ctx, "GET", urlStr, nil)
+		if err != nil {
+			return false, 0, err
+		}
+
+		s.addHeaders(req)
+		if s.compression != "none" {
+			req.Header.Set("Accept-Encoding", acceptEncoding(s.compression))
+		}
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return isRetryableRequestError(err), 0, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			io.Copy(io.Discard, resp.Body) // Read and discard to enable connection reuse
+			found = false
+			return false, 0, nil
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			retryable, retryAfter := classifyStatus(resp)
+			io.Copy(io.Discard, resp.Body) // Read and discard to enable connection reuse
+			return retryable, retryAfter, fmt.Errorf("HTTP %d", resp.StatusCode)
+		}
+
+		body, closeBody, err := decompressBody(resp)
+		if err != nil {
+			return false, 0, err
+		}
+		defer closeBody()
+
+		v, err := io.ReadAll(body)
+		if err != nil {
+			return true, 0, err // a GET can always be safely retried
+		}
+		value, found = v, true
+		return false, 0, nil
+	})
+	if err != nil || !found {
+		return nil, found, err
+	}
+
+	if s.bazelKind == "cas" && contentDigest(value).hash != d.hash {
+		s.logger.logf("GET (bazel) %s: content digest mismatch, treating as miss", urlStr)
+		return nil, false, nil
+	}
+
+	return value, true, nil
+}
+
+// bazelPut implements put for the "bazel" layout. For bazel-kind=ac it
+// writes straight to ac/{hex} derived from the key. For bazel-kind=cas it
+// writes to cas/{hex} derived from the value's own SHA-256, as a real
+// REAPI CAS requires: a server that validates the uploaded digest against
+// the content it received will only accept this if the address matches
+// what was actually sent.
+func (s *storageClient) bazelPut(ctx context.Context, key []byte, value []byte, overwrite bool) (bool, error) {
+	d := keyDigest(key)
+	if s.bazelKind == "cas" {
+		d = contentDigest(value)
+	}
+
+	if !overwrite {
+		existsURL, err := s.buildURLForPath(bazelPath(s.bazelKind, d))
+		if err != nil {
+			return false, err
+		}
+		exists, err := s.exists(ctx, existsURL)
+		if err != nil {
+			return false, err
+		}
+		if exists {
+			return false, nil
+		}
+	}
+
+	body, encodingHeaders, err := s.compressValue(value)
+	if err != nil {
+		return false, err
+	}
+
+	var stored bool
+	err = s.retry(ctx, "PUT (bazel)", s.retries, func(attemptNum int) (bool, time.Duration, error) {
+		urlStr, err := s.buildURLForPath(bazelPath(s.bazelKind, d))
+		if err != nil {
+			return false, 0, err
+		}
+
+		s.logger.logf("PUT (bazel) %s (%d bytes)", urlStr, len(value))
+		req, err := http.NewRequestWithContext(ctx, "PUT", urlStr, bytes.NewReader(body))
+		if err != nil {
+			return false, 0, err
+		}
+
+		s.addHeaders(req)
+		req.Header.Set("Content-Type", "application/octet-stream")
+		s.setCompressionRequestHeaders(req, encodingHeaders)
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			// value is fully buffered, so resending it on retry is always
+			// safe.
+			return isRetryableRequestError(err), 0, err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body) // Read and discard to enable connection reuse
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			stored = true
+			return false, 0, nil
+		}
+
+		retryable, retryAfter := classifyStatus(resp)
+		return retryable, retryAfter, fmt.Errorf("HTTP %d", resp.StatusCode)
+	})
+
+	return stored, err
+}
+
+// bazelRemove implements remove for the "bazel" layout. As with bazelGet,
+// bazel-kind=cas addresses by casKeyDigest, which generally won't match
+// where bazelPut/bazelPutStream actually wrote the value (see addressDigest).
+func (s *storageClient) bazelRemove(ctx context.Context, key []byte) (bool, error) {
+	urlStr, err := s.buildURLForPath(bazelPath(s.bazelKind, addressDigest(s.bazelKind, key)))
+	if err != nil {
+		return false, err
+	}
+
+	var removed bool
+	err = s.retry(ctx, "DELETE (bazel)", s.retries, func(attemptNum int) (bool, time.Duration, error) {
+		s.logger.logf("DELETE (bazel) %s", urlStr)
+		req, err := http.NewRequestWithContext(ctx, "DELETE", urlStr, nil)
+		if err != nil {
+			return false, 0, err
+		}
+
+		s.addHeaders(req)
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return isRetryableRequestError(err), 0, err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body) // Read and discard to enable connection reuse
+
+		if resp.StatusCode == http.StatusNotFound {
+			removed = false
+			return false, 0, nil
+		}
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			removed = true
+			return false, 0, nil
+		}
+
+		retryable, retryAfter := classifyStatus(resp)
+		return retryable, retryAfter, fmt.Errorf("HTTP %d", resp.StatusCode)
+	})
+
+	return removed, err
+}
+
+// bazelGetStream implements getStream for the "bazel" layout. For
+// bazel-kind=cas the body is buffered so its digest can be verified
+// before any bytes reach w: once w has seen data there is no way to tell
+// the peer "actually, that was corrupt". ac entries aren't content
+// addressed, so they stream straight through like the other layouts.
+func (s *storageClient) bazelGetStream(ctx context.Context, key []byte, w io.Writer) (bool, error) {
+	if s.bazelKind == "cas" {
+		value, found, err := s.bazelGet(ctx, key)
+		if err != nil || !found {
+			return found, err
+		}
+		_, err = w.Write(value)
+		return true, err
+	}
+
+	d := keyDigest(key)
+	urlStr, err := s.buildURLForPath(bazelPath(s.bazelKind, d))
+	if err != nil {
+		return false, err
+	}
+
+	var resp *http.Response
+	var found bool
+	err = s.retry(ctx, "GET (bazel stream)", s.retries, func(attemptNum int) (bool, time.Duration, error) {
+		s.logger.logf("GET (bazel stream) %s", urlStr)
+		req, err := http.NewRequestWithContext(ctx, "GET", urlStr, nil)
+		if err != nil {
+			return false, 0, err
+		}
+
+		s.addHeaders(req)
+		if s.compression != "none" {
+			req.Header.Set("Accept-Encoding", acceptEncoding(s.compression))
+		}
+
+		r, err := s.client.Do(req)
+		if err != nil {
+			return isRetryableRequestError(err), 0, err
+		}
+
+		if r.StatusCode == http.StatusNotFound {
+			io.Copy(io.Discard, r.Body) // Read and discard to enable connection reuse
+			r.Body.Close()
+			found = false
+			return false, 0, nil
+		}
+
+		if r.StatusCode != http.StatusOK {
+			retryable, retryAfter := classifyStatus(r)
+			io.Copy(io.Discard, r.Body) // Read and discard to enable connection reuse
+			r.Body.Close()
+			return retryable, retryAfter, fmt.Errorf("HTTP %d", r.StatusCode)
+		}
+
+		resp, found = r, true
+		return false, 0, nil
+	})
+	if err != nil || !found {
+		return false, err
+	}
+
+	body, closeBody, err := decompressBody(resp)
+	if err != nil {
+		return false, err
+	}
+	defer closeBody()
+
+	if _, err := io.Copy(w, body); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// bazelPutStream implements putStream for the "bazel" layout. For
+// bazel-kind=cas the upload address has to be the real SHA-256 of the
+// value (see contentDigest), same as bazelPut, since that's what a real
+// CAS server validates the upload against; computing it means reading the
+// whole stream, so this falls back to bazelPut's buffered path instead of
+// streaming. ac entries aren't content-addressed, so they stream straight
+// through without buffering.
+func (s *storageClient) bazelPutStream(ctx context.Context, key []byte, r io.Reader, size uint64, overwrite bool) (bool, error) {
+	if s.bazelKind == "cas" {
+		value := make([]byte, size)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return false, fmt.Errorf("reading value to compute its content digest: %w", err)
+		}
+		return s.bazelPut(ctx, key, value, overwrite)
+	}
+
+	d := keyDigest(key)
+	d.sizeBytes = int64(size)
+
+	if !overwrite {
+		existsURL, err := s.buildURLForPath(bazelPath(s.bazelKind, d))
+		if err != nil {
+			return false, err
+		}
+		exists, err := s.exists(ctx, existsURL)
+		if err != nil {
+			return false, err
+		}
+		if exists {
+			return false, nil
+		}
+	}
+
+	seeker, seekable := r.(io.ReadSeeker)
+	maxAttempts := s.retries
+	if !seekable {
+		maxAttempts = 0
+	}
+
+	var stored bool
+	err := s.retry(ctx, "PUT (bazel stream)", maxAttempts, func(attemptNum int) (bool, time.Duration, error) {
+		if attemptNum > 0 {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return false, 0, err
+			}
+		}
+
+		urlStr, err := s.buildURLForPath(bazelPath(s.bazelKind, d))
+		if err != nil {
+			return false, 0, err
+		}
+
+		s.logger.logf("PUT (bazel stream) %s (%d bytes)", urlStr, size)
+		body, encodingHeaders := s.compressStream(r, size)
+		// See the identical comment in storage_client.go's putStream: only
+		// the compressed-pipe body is passed through unwrapped, so a
+		// caller-owned seekable r doesn't get closed out from under a
+		// retry.
+		requestBody := io.ReadCloser(io.NopCloser(body))
+		if s.compression != "none" {
+			requestBody = body.(io.ReadCloser)
+		}
+		req, err := http.NewRequestWithContext(ctx, "PUT", urlStr, requestBody)
+		if err != nil {
+			return false, 0, err
+		}
+		if s.compression == "none" {
+			req.ContentLength = int64(size) // exact size known; avoids chunked encoding
+		}
+
+		s.addHeaders(req)
+		req.Header.Set("Content-Type", "application/octet-stream")
+		s.setCompressionRequestHeaders(req, encodingHeaders)
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return isRetryableRequestError(err), 0, err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body) // Read and discard to enable connection reuse
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			stored = true
+			return false, 0, nil
+		}
+
+		retryable, retryAfter := classifyStatus(resp)
+		return retryable, retryAfter, fmt.Errorf("HTTP %d", resp.StatusCode)
+	})
+
+	return stored, err
+}
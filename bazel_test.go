@@ -0,0 +1,335 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright 2026 Joel Rosdahl
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeREAPIServer is a minimal in-memory stand-in for a bazel-remote/
+// bb-storage HTTP endpoint: GET/PUT/HEAD/DELETE on ac/{hex} and cas/{hex},
+// with cas/{hex} additionally rejecting a PUT whose body doesn't hash to
+// the hex in the path, the way a real CAS server validates digests.
+type fakeREAPIServer struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func newFakeREAPIServer() *httptest.Server {
+	f := &fakeREAPIServer{blobs: make(map[string][]byte)}
+	return httptest.NewServer(http.HandlerFunc(f.handle))
+}
+
+func (f *fakeREAPIServer) handle(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path[1:] // strip leading "/"
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		f.mu.Lock()
+		body, ok := f.blobs[path]
+		f.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Write(body)
+
+	case http.MethodPut:
+		body := new(bytes.Buffer)
+		body.ReadFrom(r.Body)
+
+		if len(path) >= len("cas/") && path[:len("cas/")] == "cas/" {
+			wantHex := path[len("cas/"):]
+			sum := sha256.Sum256(body.Bytes())
+			if hex.EncodeToString(sum[:]) != wantHex {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		f.mu.Lock()
+		f.blobs[path] = body.Bytes()
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodDelete:
+		f.mu.Lock()
+		_, ok := f.blobs[path]
+		delete(f.blobs, path)
+		f.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newTestBazelClient(t *testing.T, serverURL string, kind string) *storageClient {
+	t.Helper()
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		t.Fatalf("parse server URL: %v", err)
+	}
+	return &storageClient{
+		client:      http.DefaultClient,
+		baseURL:     u,
+		layout:      "bazel",
+		bazelKind:   kind,
+		logger:      newLogger(""),
+		retries:     0,
+		compression: "none",
+	}
+}
+
+func TestBazelCASPutGetRoundTrip(t *testing.T) {
+	server := newFakeREAPIServer()
+	defer server.Close()
+
+	c := newTestBazelClient(t, server.URL, "cas")
+	ctx := context.Background()
+
+	value := []byte("some build artifact bytes")
+	sum := sha256.Sum256(value)
+	key := sum[:] // bazel-kind=cas addresses by content digest: key must be sha256(value)
+
+	stored, err := c.bazelPut(ctx, key, value, true)
+	if err != nil || !stored {
+		t.Fatalf("bazelPut: stored=%v err=%v", stored, err)
+	}
+
+	got, found, err := c.bazelGet(ctx, key)
+	if err != nil || !found {
+		t.Fatalf("bazelGet: found=%v err=%v", found, err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Fatalf("bazelGet: got %q, want %q", got, value)
+	}
+}
+
+func TestBazelCASGetDigestMismatchIsMiss(t *testing.T) {
+	f := &fakeREAPIServer{blobs: make(map[string][]byte)}
+	server := httptest.NewServer(http.HandlerFunc(f.handle))
+	defer server.Close()
+
+	c := newTestBazelClient(t, server.URL, "cas")
+	ctx := context.Background()
+
+	// Seed a blob directly, bypassing bazelPut's own digest validation, at
+	// a path whose hex doesn't match its content — simulating corruption
+	// or a server that doesn't itself validate digests on PUT.
+	wrongSum := sha256.Sum256([]byte("a different key"))
+	wrongKey := wrongSum[:]
+	f.blobs["cas/"+hex.EncodeToString(wrongKey)] = []byte("actual content, different from what the key implies")
+
+	_, found, err := c.bazelGet(ctx, wrongKey)
+	if err != nil {
+		t.Fatalf("bazelGet: unexpected error: %v", err)
+	}
+	if found {
+		t.Fatalf("bazelGet: expected a digest mismatch to be reported as a miss, got a hit")
+	}
+}
+
+func TestBazelACPutGetRoundTrip(t *testing.T) {
+	server := newFakeREAPIServer()
+	defer server.Close()
+
+	c := newTestBazelClient(t, server.URL, "ac")
+	ctx := context.Background()
+
+	key := []byte("some-action-cache-key")
+	value := []byte("serialized ActionResult")
+
+	stored, err := c.bazelPut(ctx, key, value, true)
+	if err != nil || !stored {
+		t.Fatalf("bazelPut: stored=%v err=%v", stored, err)
+	}
+
+	got, found, err := c.bazelGet(ctx, key)
+	if err != nil || !found {
+		t.Fatalf("bazelGet: found=%v err=%v", found, err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Fatalf("bazelGet: got %q, want %q", got, value)
+	}
+}
+
+func TestBazelCASPutStreamMatchesBufferedPut(t *testing.T) {
+	server := newFakeREAPIServer()
+	defer server.Close()
+
+	c := newTestBazelClient(t, server.URL, "cas")
+	ctx := context.Background()
+
+	value := []byte("streamed build artifact")
+	sum := sha256.Sum256(value)
+	key := sum[:]
+
+	stored, err := c.bazelPutStream(ctx, key, bytes.NewReader(value), uint64(len(value)), true)
+	if err != nil || !stored {
+		t.Fatalf("bazelPutStream: stored=%v err=%v", stored, err)
+	}
+
+	got, found, err := c.bazelGet(ctx, key)
+	if err != nil || !found {
+		t.Fatalf("bazelGet: found=%v err=%v", found, err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Fatalf("bazelGet: got %q, want %q", got, value)
+	}
+}
+
+// TestBazelCASPutStreamAddressesByContentDigest locks in that
+// bazelPutStream, like bazelPut, addresses a cas upload by the real
+// SHA-256 of the value, not by the opaque key a plain ccache client
+// actually sends — and that such a key therefore can't be used to find
+// the value again via bazelGet, only the real content digest can.
+func TestBazelCASPutStreamAddressesByContentDigest(t *testing.T) {
+	server := newFakeREAPIServer()
+	defer server.Close()
+
+	c := newTestBazelClient(t, server.URL, "cas")
+	ctx := context.Background()
+
+	value := []byte("streamed build artifact, opaquely keyed")
+	opaqueKey := []byte("some-opaque-ccache-key")
+
+	stored, err := c.bazelPutStream(ctx, opaqueKey, bytes.NewReader(value), uint64(len(value)), true)
+	if err != nil || !stored {
+		t.Fatalf("bazelPutStream: stored=%v err=%v", stored, err)
+	}
+
+	if _, found, err := c.bazelGet(ctx, opaqueKey); err != nil || found {
+		t.Fatalf("bazelGet(opaqueKey): found=%v err=%v, want a miss", found, err)
+	}
+
+	sum := sha256.Sum256(value)
+	got, found, err := c.bazelGet(ctx, sum[:])
+	if err != nil || !found {
+		t.Fatalf("bazelGet(contentDigest): found=%v err=%v", found, err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Fatalf("bazelGet(contentDigest): got %q, want %q", got, value)
+	}
+}
+
+// TestBazelCASPutStreamShortReadIsAnError guards against a regression
+// where computing the content digest via io.ReadAll(io.LimitReader(r,
+// size)) would silently accept fewer bytes than the declared size instead
+// of erroring, the way every other put/putStream path enforces size via
+// Content-Length.
+func TestBazelCASPutStreamShortReadIsAnError(t *testing.T) {
+	server := newFakeREAPIServer()
+	defer server.Close()
+
+	c := newTestBazelClient(t, server.URL, "cas")
+	ctx := context.Background()
+
+	short := bytes.NewReader([]byte("only 5"))
+	stored, err := c.bazelPutStream(ctx, []byte("key"), short, 1000, true)
+	if err == nil {
+		t.Fatalf("bazelPutStream: expected an error for a reader shorter than the declared size, got stored=%v", stored)
+	}
+}
+
+// bazelCloseTrackingReadSeeker wraps a bytes.Reader with an io.Closer, to stand
+// in for a caller-owned seekable value source that bazelPutStream must be
+// able to Seek back to the start of and reuse across retries.
+type bazelCloseTrackingReadSeeker struct {
+	*bytes.Reader
+	closeCalls int32
+}
+
+func (c *bazelCloseTrackingReadSeeker) Close() error {
+	atomic.AddInt32(&c.closeCalls, 1)
+	return nil
+}
+
+// TestBazelPutStreamUncompressedRetryDoesNotCloseCallerReader guards
+// against a regression where skipping io.NopCloser unconditionally (rather
+// than only for compressStream's own pipe reader) let the HTTP transport
+// close a caller-owned, closer-implementing body on an attempt that gets
+// retried, which would break the next attempt's Seek.
+func TestBazelPutStreamUncompressedRetryDoesNotCloseCallerReader(t *testing.T) {
+	var requestNum int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		io.Copy(io.Discard, r.Body)
+		if atomic.AddInt32(&requestNum, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	c := newTestBazelClient(t, server.URL, "ac")
+	c.retries = 1
+	c.retryBaseDelay = time.Millisecond
+	c.retryMaxDelay = time.Millisecond
+
+	value := []byte("retry me")
+	r := &bazelCloseTrackingReadSeeker{Reader: bytes.NewReader(value)}
+
+	stored, err := c.bazelPutStream(context.Background(), []byte("retry-key"), r, uint64(len(value)), true)
+	if err != nil || !stored {
+		t.Fatalf("bazelPutStream: stored=%v err=%v", stored, err)
+	}
+	if atomic.LoadInt32(&requestNum) != 2 {
+		t.Fatalf("expected 2 attempts (1 failure + 1 success), got %d", requestNum)
+	}
+	if calls := atomic.LoadInt32(&r.closeCalls); calls != 0 {
+		t.Fatalf("caller's reader was Closed %d times; the transport must only close the request's own NopCloser wrapper", calls)
+	}
+}
+
+func TestBazelRemove(t *testing.T) {
+	server := newFakeREAPIServer()
+	defer server.Close()
+
+	c := newTestBazelClient(t, server.URL, "ac")
+	ctx := context.Background()
+
+	key := []byte("removable-key")
+	value := []byte("value")
+
+	if _, err := c.bazelPut(ctx, key, value, true); err != nil {
+		t.Fatalf("bazelPut: %v", err)
+	}
+
+	removed, err := c.bazelRemove(ctx, key)
+	if err != nil || !removed {
+		t.Fatalf("bazelRemove: removed=%v err=%v", removed, err)
+	}
+
+	_, found, err := c.bazelGet(ctx, key)
+	if err != nil {
+		t.Fatalf("bazelGet after remove: %v", err)
+	}
+	if found {
+		t.Fatalf("bazelGet after remove: expected a miss")
+	}
+}
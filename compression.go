@@ -0,0 +1,119 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright 2026 Joel Rosdahl
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var zstdEncoderPool sync.Pool
+var zstdDecoderPool sync.Pool
+
+// compressWriter wraps w so writes are compressed according to
+// compression ("gzip" or "zstd") before reaching it. Closing the returned
+// writer flushes and finalizes the compressed stream. zstd encoders are
+// pooled to avoid rebuilding their tables on every request.
+func compressWriter(w io.Writer, compression string, level int) (io.WriteCloser, error) {
+	switch compression {
+	case "gzip":
+		if level <= 0 {
+			return gzip.NewWriter(w), nil
+		}
+		return gzip.NewWriterLevel(w, level)
+
+	case "zstd":
+		var enc *zstd.Encoder
+		if pooled, ok := zstdEncoderPool.Get().(*zstd.Encoder); ok {
+			pooled.Reset(w)
+			enc = pooled
+		} else {
+			var err error
+			enc, err = zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return &pooledZstdWriter{enc: enc}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported compression: %s", compression)
+	}
+}
+
+type pooledZstdWriter struct {
+	enc *zstd.Encoder
+}
+
+func (p *pooledZstdWriter) Write(b []byte) (int, error) {
+	return p.enc.Write(b)
+}
+
+func (p *pooledZstdWriter) Close() error {
+	err := p.enc.Close()
+	zstdEncoderPool.Put(p.enc)
+	return err
+}
+
+// decompressReader wraps r so reads come back decompressed according to
+// contentEncoding, the value of a response's Content-Encoding header. An
+// empty or "identity" encoding returns r unchanged, so a server that
+// ignores Accept-Encoding and returns the object as-is is handled
+// transparently. The returned io.Closer, if non-nil, must be closed once
+// the caller is done reading, in addition to the underlying response
+// body.
+func decompressReader(r io.Reader, contentEncoding string) (io.Reader, io.Closer, error) {
+	switch contentEncoding {
+	case "", "identity":
+		return r, nil, nil
+
+	case "gzip":
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gr, gr, nil
+
+	case "zstd":
+		var dec *zstd.Decoder
+		if pooled, ok := zstdDecoderPool.Get().(*zstd.Decoder); ok {
+			if err := pooled.Reset(r); err != nil {
+				return nil, nil, err
+			}
+			dec = pooled
+		} else {
+			var err error
+			dec, err = zstd.NewReader(r)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return dec, &pooledZstdReader{dec: dec}, nil
+
+	default:
+		return nil, nil, fmt.Errorf("unsupported content-encoding: %s", contentEncoding)
+	}
+}
+
+type pooledZstdReader struct {
+	dec *zstd.Decoder
+}
+
+func (p *pooledZstdReader) Close() error {
+	zstdDecoderPool.Put(p.dec)
+	return nil
+}
+
+// acceptEncoding is the Accept-Encoding header value advertised on GETs
+// when compression is enabled, listing the configured codec first.
+func acceptEncoding(compression string) string {
+	if compression == "gzip" {
+		return "gzip, zstd"
+	}
+	return "zstd, gzip"
+}
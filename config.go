@@ -4,6 +4,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net/url"
 	"os"
@@ -13,14 +14,40 @@ import (
 	"time"
 )
 
+const (
+	defaultChunkSize   = 64 * 1024
+	defaultMaxInflight = 8
+
+	defaultRetries     = 5
+	defaultRetryBaseMS = 100
+	defaultRetryMaxMS  = 5000
+)
+
 type config struct {
-	LogFile     string
-	IPCEndpoint string
-	URL         *url.URL
-	IdleTimeout time.Duration
-	Layout      string
-	BearerToken string
-	Headers     map[string]string
+	LogFile         string
+	IPCEndpoint     string
+	URL             *url.URL
+	IdleTimeout     time.Duration
+	Layout          string
+	BazelKind       string
+	BearerToken     string
+	Headers         map[string]string
+	ChunkSize       int
+	MaxInflight     int
+	Retries         int
+	RetryBaseDelay  time.Duration
+	RetryMaxDelay   time.Duration
+	RetryMaxElapsed time.Duration
+
+	CACertFile            string
+	ClientCertFile        string
+	ClientKeyFile         string
+	TLSInsecureSkipVerify bool
+	TLSServerName         string
+	TLSConfig             *tls.Config
+
+	Compression      string
+	CompressionLevel int
 }
 
 func parseConfig() (*config, error) {
@@ -29,10 +56,17 @@ func parseConfig() (*config, error) {
 		ipcEndpoint = `\\.\pipe\` + ipcEndpoint
 	}
 	cfg := &config{
-		LogFile:     os.Getenv("CRSH_LOGFILE"),
-		IPCEndpoint: ipcEndpoint,
-		Layout:      "subdirs",
-		Headers:     make(map[string]string),
+		LogFile:        os.Getenv("CRSH_LOGFILE"),
+		IPCEndpoint:    ipcEndpoint,
+		Layout:         "subdirs",
+		BazelKind:      "ac",
+		Compression:    "none",
+		Headers:        make(map[string]string),
+		ChunkSize:      defaultChunkSize,
+		MaxInflight:    defaultMaxInflight,
+		Retries:        defaultRetries,
+		RetryBaseDelay: defaultRetryBaseMS * time.Millisecond,
+		RetryMaxDelay:  defaultRetryMaxMS * time.Millisecond,
 	}
 
 	urlStr := os.Getenv("CRSH_URL")
@@ -55,6 +89,56 @@ func parseConfig() (*config, error) {
 	}
 	cfg.IdleTimeout = time.Duration(timeoutSecs) * time.Second
 
+	maxInflight := os.Getenv("CRSH_MAX_INFLIGHT")
+	if maxInflight == "" {
+		maxInflight = strconv.Itoa(defaultMaxInflight)
+	}
+	maxInflightNum, err := strconv.Atoi(maxInflight)
+	if err != nil || maxInflightNum <= 0 {
+		return nil, fmt.Errorf("invalid CRSH_MAX_INFLIGHT: %s", maxInflight)
+	}
+	cfg.MaxInflight = maxInflightNum
+
+	retries := os.Getenv("CRSH_RETRIES")
+	if retries == "" {
+		retries = strconv.Itoa(defaultRetries)
+	}
+	retriesNum, err := strconv.Atoi(retries)
+	if err != nil || retriesNum < 0 {
+		return nil, fmt.Errorf("invalid CRSH_RETRIES: %s", retries)
+	}
+	cfg.Retries = retriesNum
+
+	retryBaseMS := os.Getenv("CRSH_RETRY_BASE_MS")
+	if retryBaseMS == "" {
+		retryBaseMS = strconv.Itoa(defaultRetryBaseMS)
+	}
+	retryBaseMSNum, err := strconv.Atoi(retryBaseMS)
+	if err != nil || retryBaseMSNum <= 0 {
+		return nil, fmt.Errorf("invalid CRSH_RETRY_BASE_MS: %s", retryBaseMS)
+	}
+	cfg.RetryBaseDelay = time.Duration(retryBaseMSNum) * time.Millisecond
+
+	retryMaxMS := os.Getenv("CRSH_RETRY_MAX_MS")
+	if retryMaxMS == "" {
+		retryMaxMS = strconv.Itoa(defaultRetryMaxMS)
+	}
+	retryMaxMSNum, err := strconv.Atoi(retryMaxMS)
+	if err != nil || retryMaxMSNum <= 0 {
+		return nil, fmt.Errorf("invalid CRSH_RETRY_MAX_MS: %s", retryMaxMS)
+	}
+	cfg.RetryMaxDelay = time.Duration(retryMaxMSNum) * time.Millisecond
+
+	retryMaxElapsed := os.Getenv("CRSH_RETRY_MAX_ELAPSED")
+	if retryMaxElapsed == "" {
+		retryMaxElapsed = "0"
+	}
+	retryMaxElapsedSecs, err := strconv.Atoi(retryMaxElapsed)
+	if err != nil || retryMaxElapsedSecs < 0 {
+		return nil, fmt.Errorf("invalid CRSH_RETRY_MAX_ELAPSED: %s", retryMaxElapsed)
+	}
+	cfg.RetryMaxElapsed = time.Duration(retryMaxElapsedSecs) * time.Second
+
 	numAttr := os.Getenv("CRSH_NUM_ATTR")
 	if numAttr == "" {
 		numAttr = "0"
@@ -73,8 +157,19 @@ func parseConfig() (*config, error) {
 		switch key {
 		case "layout":
 			cfg.Layout = value
+		case "bazel-kind":
+			if value != "ac" && value != "cas" {
+				return nil, fmt.Errorf("invalid bazel-kind attribute: %s (must be ac or cas)", value)
+			}
+			cfg.BazelKind = value
 		case "bearer-token":
 			cfg.BearerToken = value
+		case "chunk-size":
+			chunkSize, err := strconv.Atoi(value)
+			if err != nil || chunkSize <= 0 {
+				return nil, fmt.Errorf("invalid chunk-size attribute: %s", value)
+			}
+			cfg.ChunkSize = chunkSize
 		case "header":
 			idx := strings.Index(value, "=")
 			if idx <= 0 {
@@ -83,8 +178,39 @@ func parseConfig() (*config, error) {
 			headerKey := value[:idx]
 			headerValue := value[idx+1:]
 			cfg.Headers[headerKey] = headerValue
+		case "ca-cert":
+			cfg.CACertFile = value
+		case "client-cert":
+			cfg.ClientCertFile = value
+		case "client-key":
+			cfg.ClientKeyFile = value
+		case "tls-insecure-skip-verify":
+			skipVerify, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid tls-insecure-skip-verify attribute: %s", value)
+			}
+			cfg.TLSInsecureSkipVerify = skipVerify
+		case "tls-server-name":
+			cfg.TLSServerName = value
+		case "compression":
+			if value != "none" && value != "zstd" && value != "gzip" {
+				return nil, fmt.Errorf("invalid compression attribute: %s (must be none, zstd or gzip)", value)
+			}
+			cfg.Compression = value
+		case "compression-level":
+			level, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid compression-level attribute: %s", value)
+			}
+			cfg.CompressionLevel = level
 		}
 	}
 
+	tlsConfig, err := buildTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cfg.TLSConfig = tlsConfig
+
 	return cfg, nil
 }
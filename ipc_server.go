@@ -15,7 +15,7 @@ import (
 type ipcServer struct {
 	config    *config
 	logger    *logger
-	storage   *storageClient
+	storage   storage
 	listener  net.Listener
 	ctx       context.Context
 	cancel    context.CancelFunc
@@ -78,6 +78,16 @@ func (s *ipcServer) acceptLoop() {
 	}
 }
 
+// handleConnection reads requests off conn one at a time (conn only ever
+// has a single reader), but starts each get/put/remove's backend call
+// immediately in its own goroutine, bounded to config.MaxInflight in
+// flight at once, so a slow request doesn't hold up the rest. Only the
+// write of the response bytes is serialized back into the order requests
+// were read: each request's write closure waits for a channel that the
+// previous request closes once its own response has been written.
+// Streaming get/put requests (and stop) own the connection for the
+// duration of their I/O, so they run inline rather than being handed off
+// to a worker.
 func (s *ipcServer) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
@@ -86,25 +96,70 @@ func (s *ipcServer) handleConnection(conn net.Conn) {
 		return
 	}
 
+	connCtx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	sem := make(chan struct{}, s.config.MaxInflight)
+	var prevDone chan struct{}
+	var wg sync.WaitGroup
+
 	for {
-		shouldStop, err := processRequest(conn, s.storage, s.logger)
+		perform, inline, stop, err := processRequest(conn, s.storage, s.logger, s.config.ChunkSize)
 		if err != nil {
 			if err == io.EOF {
 				s.logger.logf("Client disconnected")
 			} else {
 				s.logger.logf("Request processing error: %v", err)
 			}
-			return
+			cancel()
+			break
 		}
 
-		if shouldStop {
-			s.logger.logf("Stop requested, shutting down")
-			s.cancel()
-			return
+		myDone := make(chan struct{})
+		waitFor := prevDone
+		prevDone = myDone
+
+		if inline {
+			// perform does its backend call and response write as one
+			// synchronous step (it reads/writes conn directly), so unlike
+			// the async path below, the wait for the previous request's
+			// write has to happen before calling it, not between it and
+			// write().
+			if waitFor != nil {
+				<-waitFor
+			}
+			write := perform(connCtx)
+			if err := write(); err != nil {
+				s.logger.logf("Request processing error: %v", err)
+			}
+			close(myDone)
+			if stop {
+				s.logger.logf("Stop requested, shutting down")
+				wg.Wait()
+				s.cancel()
+				return
+			}
+		} else {
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				write := perform(connCtx)
+				if waitFor != nil {
+					<-waitFor
+				}
+				defer close(myDone)
+				if err := write(); err != nil {
+					s.logger.logf("Request processing error: %v", err)
+				}
+			}()
 		}
 
 		s.resetIdleTimer()
 	}
+
+	wg.Wait()
 }
 
 func (s *ipcServer) resetIdleTimer() {
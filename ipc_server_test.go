@@ -0,0 +1,194 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright 2026 Joel Rosdahl
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeOrderedStorage is a storage implementation whose backend calls
+// complete in a caller-controlled order (via delays keyed by the request's
+// key), independent of the order requests were issued in, so it can
+// exercise handleConnection's guarantee that responses are still written
+// back in request order regardless of which backend call finishes first.
+type fakeOrderedStorage struct {
+	delays map[string]time.Duration
+}
+
+func (f *fakeOrderedStorage) sleep(key []byte) {
+	if d, ok := f.delays[string(key)]; ok {
+		time.Sleep(d)
+	}
+}
+
+func (f *fakeOrderedStorage) get(ctx context.Context, key []byte) ([]byte, bool, error) {
+	f.sleep(key)
+	return append([]byte("value-"), key...), true, nil
+}
+
+func (f *fakeOrderedStorage) put(ctx context.Context, key []byte, value []byte, overwrite bool) (bool, error) {
+	f.sleep(key)
+	return true, nil
+}
+
+func (f *fakeOrderedStorage) remove(ctx context.Context, key []byte) (bool, error) {
+	f.sleep(key)
+	return true, nil
+}
+
+func (f *fakeOrderedStorage) getStream(ctx context.Context, key []byte, w io.Writer) (bool, error) {
+	f.sleep(key)
+	_, err := w.Write(append([]byte("streamed-"), key...))
+	return true, err
+}
+
+func (f *fakeOrderedStorage) putStream(ctx context.Context, key []byte, r io.Reader, size uint64, overwrite bool) (bool, error) {
+	f.sleep(key)
+	io.Copy(io.Discard, r)
+	return true, nil
+}
+
+// writeRequestKey writes a key in the length-prefixed shape readKey expects.
+func writeRequestKey(w io.Writer, key []byte) {
+	writeByte(w, uint8(len(key)))
+	w.Write(key)
+}
+
+// readResponseValue reads a value in the length-prefixed shape writeValue
+// produces.
+func readResponseValue(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+	var valueLen uint64
+	if err := binary.Read(r, binary.NativeEndian, &valueLen); err != nil {
+		t.Fatalf("reading value length: %v", err)
+	}
+	value := make([]byte, valueLen)
+	if _, err := io.ReadFull(r, value); err != nil {
+		t.Fatalf("reading value: %v", err)
+	}
+	return value
+}
+
+// readGreeting drains the protocol-version byte and the capability list
+// handleConnection sends as the first thing on a new connection.
+func readGreeting(t *testing.T, r io.Reader) {
+	t.Helper()
+	if _, err := readByte(r); err != nil {
+		t.Fatalf("reading protocol version: %v", err)
+	}
+	numCaps, err := readByte(r)
+	if err != nil {
+		t.Fatalf("reading capability count: %v", err)
+	}
+	for i := byte(0); i < numCaps; i++ {
+		if _, err := readByte(r); err != nil {
+			t.Fatalf("reading capability %d: %v", i, err)
+		}
+	}
+}
+
+// TestHandleConnectionPreservesResponseOrderUnderConcurrentBackendCalls
+// drives a single connection through get/put/remove plus an inline stream
+// get, where the first request's backend call is the slowest, and checks
+// that the responses still arrive in the order the requests were sent
+// rather than the order their backend calls completed in.
+func TestHandleConnectionPreservesResponseOrderUnderConcurrentBackendCalls(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+
+	store := &fakeOrderedStorage{delays: map[string]time.Duration{
+		"slow": 50 * time.Millisecond,
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &ipcServer{
+		config:  &config{MaxInflight: 4, ChunkSize: defaultChunkSize},
+		logger:  newLogger(""),
+		storage: store,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.handleConnection(serverConn)
+		close(done)
+	}()
+
+	readGreeting(t, clientConn)
+
+	// Request order: a slow GET first, then three fast requests (a PUT, a
+	// REMOVE, and an inline stream GET), then STOP. If responses came back
+	// in completion order instead of request order, the slow GET's
+	// response would land last instead of first. Requests are written from
+	// a separate goroutine, concurrently with reading responses below: an
+	// inline request's response write happens on handleConnection's own
+	// read loop goroutine, so it would deadlock against a client that
+	// writes every request before reading any response.
+	go func() {
+		writeByte(clientConn, requestGet)
+		writeRequestKey(clientConn, []byte("slow"))
+
+		writeByte(clientConn, requestPut)
+		writeRequestKey(clientConn, []byte("fast-put"))
+		writeByte(clientConn, 0) // flags: no overwrite
+		writeValue(clientConn, []byte("v"))
+
+		writeByte(clientConn, requestRemove)
+		writeRequestKey(clientConn, []byte("fast-remove"))
+
+		writeByte(clientConn, requestGetStream)
+		writeRequestKey(clientConn, []byte("fast-stream"))
+
+		writeByte(clientConn, requestStop)
+	}()
+
+	// GET "slow": OK + value, even though its backend call finishes after
+	// those of the PUT and REMOVE behind it.
+	respType, err := readByte(clientConn)
+	if err != nil || respType != responseOK {
+		t.Fatalf("GET slow response: got %v, err %v, want responseOK", respType, err)
+	}
+	if got := string(readResponseValue(t, clientConn)); got != "value-slow" {
+		t.Fatalf("GET slow value: got %q", got)
+	}
+
+	// PUT "fast-put": OK, no body.
+	respType, err = readByte(clientConn)
+	if err != nil || respType != responseOK {
+		t.Fatalf("PUT response: got %v, err %v, want responseOK", respType, err)
+	}
+
+	// REMOVE "fast-remove": OK, no body.
+	respType, err = readByte(clientConn)
+	if err != nil || respType != responseOK {
+		t.Fatalf("REMOVE response: got %v, err %v, want responseOK", respType, err)
+	}
+
+	// GET (stream) "fast-stream": OK + chunked value.
+	respType, err = readByte(clientConn)
+	if err != nil || respType != responseOK {
+		t.Fatalf("GET stream response: got %v, err %v, want responseOK", respType, err)
+	}
+	cr := newChunkReader(clientConn)
+	streamed, err := io.ReadAll(cr)
+	if err != nil {
+		t.Fatalf("reading streamed value: %v", err)
+	}
+	if string(streamed) != "streamed-fast-stream" {
+		t.Fatalf("streamed value: got %q", streamed)
+	}
+
+	// STOP: OK, then the server closes the connection.
+	respType, err = readByte(clientConn)
+	if err != nil || respType != responseOK {
+		t.Fatalf("STOP response: got %v, err %v, want responseOK", respType, err)
+	}
+
+	clientConn.Close()
+	<-done
+}
@@ -4,25 +4,31 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
 )
 
 type storage interface {
-	get(key []byte) ([]byte, bool, error)
-	put(key []byte, value []byte, overwrite bool) (bool, error)
-	remove(key []byte) (bool, error)
+	get(ctx context.Context, key []byte) ([]byte, bool, error)
+	put(ctx context.Context, key []byte, value []byte, overwrite bool) (bool, error)
+	remove(ctx context.Context, key []byte) (bool, error)
+	getStream(ctx context.Context, key []byte, w io.Writer) (bool, error)
+	putStream(ctx context.Context, key []byte, r io.Reader, size uint64, overwrite bool) (bool, error)
 }
 
 const (
 	protocolVersion = 0x01
 	cap0            = 0x00 // get/put/remove/stop operations
+	cap1            = 0x01 // chunked value framing for streaming get/put
 
-	requestGet    = 0x00
-	requestPut    = 0x01
-	requestRemove = 0x02
-	requestStop   = 0x03
+	requestGet       = 0x00
+	requestPut       = 0x01
+	requestRemove    = 0x02
+	requestStop      = 0x03
+	requestGetStream = 0x04
+	requestPutStream = 0x05
 
 	responseOK   = 0x00
 	responseNoop = 0x01
@@ -36,7 +42,7 @@ func writeGreeting(w io.Writer) error {
 		return err
 	}
 
-	caps := []byte{cap0}
+	caps := []byte{cap0, cap1}
 	if err := writeByte(w, uint8(len(caps))); err != nil {
 		return err
 	}
@@ -109,6 +115,167 @@ func writeValue(w io.Writer, value []byte) error {
 	return err
 }
 
+// chunkErrorMarker is a chunk length no real chunk ever has (chunkWriter
+// only ever emits chunks up to maxChunkSize, or the zero-length
+// terminator). A chunk stream that fails after it has already started
+// can't fall back to a plain top-level response byte — that would land
+// mid-stream and desync the connection — so it ends the stream with this
+// marker followed by a message instead; see writeChunkError.
+const chunkErrorMarker = ^uint32(0)
+
+// chunkWriter frames each Write call as one or more uint32 length-prefixed
+// chunks of at most maxChunkSize bytes. Close emits the terminating
+// zero-length chunk.
+type chunkWriter struct {
+	w            io.Writer
+	maxChunkSize int
+}
+
+func newChunkWriter(w io.Writer, maxChunkSize int) *chunkWriter {
+	return &chunkWriter{w: w, maxChunkSize: maxChunkSize}
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > c.maxChunkSize {
+			n = c.maxChunkSize
+		}
+		if err := writeChunk(c.w, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (c *chunkWriter) Close() error {
+	return writeChunk(c.w, nil)
+}
+
+func writeChunk(w io.Writer, chunk []byte) error {
+	if err := binary.Write(w, binary.NativeEndian, uint32(len(chunk))); err != nil {
+		return err
+	}
+	if len(chunk) == 0 {
+		return nil
+	}
+	_, err := w.Write(chunk)
+	return err
+}
+
+// writeChunkError terminates a chunk stream with chunkErrorMarker followed
+// by a message, instead of the normal zero-length terminator. The peer's
+// chunkReader surfaces this as an error from Read rather than io.EOF.
+func writeChunkError(w io.Writer, msg string) error {
+	if err := binary.Write(w, binary.NativeEndian, chunkErrorMarker); err != nil {
+		return err
+	}
+	return writeMsg(w, msg)
+}
+
+// chunkReader reads a sequence of length-prefixed chunks written by the
+// peer's chunkWriter, presenting them as a single stream that ends at the
+// terminating zero-length chunk, or fails with an error if the peer ended
+// it with chunkErrorMarker instead.
+type chunkReader struct {
+	r   io.Reader
+	rem uint32
+	err error // io.EOF or the peer's failure, once the stream has ended
+}
+
+func newChunkReader(r io.Reader) *chunkReader {
+	return &chunkReader{r: r}
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.rem == 0 {
+		var chunkLen uint32
+		if err := binary.Read(c.r, binary.NativeEndian, &chunkLen); err != nil {
+			return 0, err
+		}
+		if chunkLen == chunkErrorMarker {
+			msg, err := readMsg(c.r)
+			if err != nil {
+				return 0, err
+			}
+			c.err = fmt.Errorf("peer stream failed: %s", msg)
+			return 0, c.err
+		}
+		if chunkLen == 0 {
+			c.err = io.EOF
+			return 0, io.EOF
+		}
+		c.rem = chunkLen
+	}
+	if uint32(len(p)) > c.rem {
+		p = p[:c.rem]
+	}
+	n, err := c.r.Read(p)
+	c.rem -= uint32(n)
+	return n, err
+}
+
+// drain reads cr to completion, discarding its contents, so that a chunked
+// value the caller gave up on reading part-way through doesn't leave
+// unread chunks behind on the connection.
+func drain(cr *chunkReader) {
+	io.Copy(io.Discard, cr)
+}
+
+// streamWriter lazily writes the OK response byte on the first Write (or on
+// Close, if the value is empty), then frames the bytes as chunks. This lets
+// handleGetStream report success only once the backing store has confirmed
+// the value exists, without buffering the value itself.
+type streamWriter struct {
+	cw      *chunkWriter
+	started bool
+}
+
+func newStreamWriter(w io.Writer, maxChunkSize int) *streamWriter {
+	return &streamWriter{cw: newChunkWriter(w, maxChunkSize)}
+}
+
+func (s *streamWriter) start() error {
+	if s.started {
+		return nil
+	}
+	s.started = true
+	return writeOK(s.cw.w)
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if err := s.start(); err != nil {
+		return 0, err
+	}
+	return s.cw.Write(p)
+}
+
+func (s *streamWriter) Close() error {
+	if err := s.start(); err != nil {
+		return err
+	}
+	return s.cw.Close()
+}
+
+// fail reports a backend error. If nothing has been written yet, a plain
+// top-level error response is still safe, same as a non-streamed request.
+// Once streaming has started, the OK byte and at least one chunk are
+// already on the wire, so it instead ends the chunk stream with
+// writeChunkError, which the peer's chunkReader reports as an error
+// instead of a clean EOF.
+func (s *streamWriter) fail(msg string) error {
+	if !s.started {
+		return writeErr(s.cw.w, msg)
+	}
+	return writeChunkError(s.cw.w, msg)
+}
+
 func writeByte(w io.Writer, b byte) error {
 	_, err := w.Write([]byte{b})
 	return err
@@ -147,87 +314,116 @@ func readMsg(r io.Reader) (string, error) {
 	return string(msg), nil
 }
 
-func handleGet(r io.Reader, w io.Writer, s storage, logger *logger) error {
-	key, err := readKey(r)
-	if err != nil {
-		return err
-	}
-
+// respondGet starts the GET against the backend immediately and returns a
+// write closure that sends the result once called. This lets the caller
+// run the (potentially slow) backend call concurrently with other
+// requests, while still deciding separately, and later, when the response
+// bytes actually go out on conn.
+func respondGet(ctx context.Context, w io.Writer, s storage, logger *logger, key []byte) func() error {
 	logger.logf("GET request for key %x", key)
 
-	value, found, err := s.get(key)
-	if err != nil {
-		logger.logf("GET error: %v", err)
-		return writeErr(w, err.Error())
-	}
+	value, found, err := s.get(ctx, key)
+	return func() error {
+		if err != nil {
+			logger.logf("GET error: %v", err)
+			return writeErr(w, err.Error())
+		}
 
-	if !found {
-		logger.logf("GET key not found")
-		return writeNoop(w)
-	}
+		if !found {
+			logger.logf("GET key not found")
+			return writeNoop(w)
+		}
 
-	logger.logf("GET success (%d bytes)", len(value))
-	if err := writeOK(w); err != nil {
-		return err
+		logger.logf("GET success (%d bytes)", len(value))
+		if err := writeOK(w); err != nil {
+			return err
+		}
+		return writeValue(w, value)
 	}
-	return writeValue(w, value)
 }
 
-func handlePut(r io.Reader, w io.Writer, s storage, logger *logger) error {
-	key, err := readKey(r)
-	if err != nil {
-		return err
-	}
+// respondPut behaves like respondGet: the backend PUT runs immediately,
+// and the returned closure only writes the already-known result.
+func respondPut(ctx context.Context, w io.Writer, s storage, logger *logger, key []byte, value []byte, overwrite bool) func() error {
+	logger.logf("PUT request for key %x (%d bytes)", key, len(value))
 
-	flags, err := readByte(r)
-	if err != nil {
-		return err
+	stored, err := s.put(ctx, key, value, overwrite)
+	return func() error {
+		if err != nil {
+			logger.logf("PUT error: %v", err)
+			return writeErr(w, err.Error())
+		}
+
+		if !stored {
+			logger.logf("PUT not stored")
+			return writeNoop(w)
+		}
+
+		logger.logf("PUT success")
+		return writeOK(w)
 	}
+}
 
-	value, err := readValue(r)
-	if err != nil {
-		return err
+// respondRemove behaves like respondGet: the backend removal runs
+// immediately, and the returned closure only writes the already-known
+// result.
+func respondRemove(ctx context.Context, w io.Writer, s storage, logger *logger, key []byte) func() error {
+	logger.logf("REMOVE request for key %x", key)
+
+	removed, err := s.remove(ctx, key)
+	return func() error {
+		if err != nil {
+			logger.logf("REMOVE error: %v", err)
+			return writeErr(w, err.Error())
+		}
+
+		if !removed {
+			logger.logf("REMOVE key not found")
+			return writeNoop(w)
+		}
+
+		logger.logf("REMOVE success")
+		return writeOK(w)
 	}
+}
 
-	overwrite := (flags & putFlagOverwrite) != 0
-	logger.logf("PUT request for key %x (%d bytes)", key, len(value))
+func respondGetStream(ctx context.Context, w io.Writer, s storage, logger *logger, key []byte, maxChunkSize int) error {
+	logger.logf("GET (stream) request for key %x", key)
 
-	stored, err := s.put(key, value, overwrite)
+	sw := newStreamWriter(w, maxChunkSize)
+	found, err := s.getStream(ctx, key, sw)
 	if err != nil {
-		logger.logf("PUT error: %v", err)
-		return writeErr(w, err.Error())
+		logger.logf("GET (stream) error: %v", err)
+		return sw.fail(err.Error())
 	}
 
-	if !stored {
-		logger.logf("PUT not stored")
+	if !found {
+		logger.logf("GET (stream) key not found")
 		return writeNoop(w)
 	}
 
-	logger.logf("PUT success")
-	return writeOK(w)
+	logger.logf("GET (stream) success")
+	return sw.Close()
 }
 
-func handleRemove(r io.Reader, w io.Writer, s storage, logger *logger) error {
-	key, err := readKey(r)
-	if err != nil {
-		return err
-	}
+func respondPutStream(ctx context.Context, conn io.ReadWriter, s storage, logger *logger, key []byte, size uint64, overwrite bool) error {
+	logger.logf("PUT (stream) request for key %x (%d bytes)", key, size)
 
-	logger.logf("REMOVE request for key %x", key)
-
-	removed, err := s.remove(key)
+	cr := newChunkReader(conn)
+	stored, err := s.putStream(ctx, key, cr, size, overwrite)
+	drain(cr) // keep the connection in sync if the store stopped reading early
 	if err != nil {
-		logger.logf("REMOVE error: %v", err)
-		return writeErr(w, err.Error())
+		logger.logf("PUT (stream) error: %v", err)
+		return writeErr(conn, err.Error())
 	}
 
-	if !removed {
-		logger.logf("REMOVE key not found")
-		return writeNoop(w)
+	if !stored {
+		logger.logf("PUT (stream) not stored")
+		return writeNoop(conn)
 	}
 
-	logger.logf("REMOVE success")
-	return writeOK(w)
+	logger.logf("PUT (stream) success")
+	return writeOK(conn)
 }
 
 func handleStop(w io.Writer, logger *logger) error {
@@ -235,34 +431,103 @@ func handleStop(w io.Writer, logger *logger) error {
 	return writeOK(w)
 }
 
-func processRequest(conn io.ReadWriter, s storage, logger *logger) (bool, error) {
+// processRequest reads one full request from conn, including any bounded
+// request body, and returns a perform closure. Calling perform(ctx) starts
+// the backend operation right away and returns a write closure that sends
+// the result on conn; the caller can therefore run perform for several
+// requests concurrently (e.g. while a slow PUT is in flight) and only
+// needs to serialize the write closures, in the order requests were read,
+// to keep conn's single byte stream consistent.
+//
+// Streaming get/put requests can't be split this way, since reading their
+// value *is* the backend operation (the value is piped straight to/from
+// the HTTP body); inline is true for those, and for requestStop, to tell
+// the caller to call perform immediately rather than handing it to a
+// worker. Their perform closures do the full request, including the
+// write, synchronously, and return an already-resolved write closure.
+func processRequest(conn io.ReadWriter, s storage, logger *logger, maxChunkSize int) (perform func(context.Context) func() error, inline bool, stop bool, err error) {
 	reqType, err := readRequest(conn)
 	if err != nil {
-		return false, err
+		return nil, false, false, err
 	}
 
 	switch reqType {
 	case requestGet:
-		if err := handleGet(conn, conn, s, logger); err != nil {
-			return false, err
+		key, err := readKey(conn)
+		if err != nil {
+			return nil, false, false, err
 		}
+		return func(ctx context.Context) func() error {
+			return respondGet(ctx, conn, s, logger, key)
+		}, false, false, nil
+
 	case requestPut:
-		if err := handlePut(conn, conn, s, logger); err != nil {
-			return false, err
+		key, err := readKey(conn)
+		if err != nil {
+			return nil, false, false, err
+		}
+		flags, err := readByte(conn)
+		if err != nil {
+			return nil, false, false, err
 		}
+		value, err := readValue(conn)
+		if err != nil {
+			return nil, false, false, err
+		}
+		overwrite := (flags & putFlagOverwrite) != 0
+		return func(ctx context.Context) func() error {
+			return respondPut(ctx, conn, s, logger, key, value, overwrite)
+		}, false, false, nil
+
 	case requestRemove:
-		if err := handleRemove(conn, conn, s, logger); err != nil {
-			return false, err
+		key, err := readKey(conn)
+		if err != nil {
+			return nil, false, false, err
 		}
-	case requestStop:
-		if err := handleStop(conn, logger); err != nil {
-			return false, err
+		return func(ctx context.Context) func() error {
+			return respondRemove(ctx, conn, s, logger, key)
+		}, false, false, nil
+
+	case requestGetStream:
+		key, err := readKey(conn)
+		if err != nil {
+			return nil, false, false, err
 		}
-		return true, nil // stop the server
+		return func(ctx context.Context) func() error {
+			err := respondGetStream(ctx, conn, s, logger, key, maxChunkSize)
+			return func() error { return err }
+		}, true, false, nil
+
+	case requestPutStream:
+		key, err := readKey(conn)
+		if err != nil {
+			return nil, false, false, err
+		}
+		flags, err := readByte(conn)
+		if err != nil {
+			return nil, false, false, err
+		}
+		var size uint64
+		if err := binary.Read(conn, binary.NativeEndian, &size); err != nil {
+			return nil, false, false, err
+		}
+		overwrite := (flags & putFlagOverwrite) != 0
+		return func(ctx context.Context) func() error {
+			err := respondPutStream(ctx, conn, s, logger, key, size, overwrite)
+			return func() error { return err }
+		}, true, false, nil
+
+	case requestStop:
+		return func(context.Context) func() error {
+			err := handleStop(conn, logger)
+			return func() error { return err }
+		}, true, true, nil
+
 	default:
 		logger.logf("Unknown request type: 0x%02x", reqType)
-		return false, writeErr(conn, fmt.Sprintf("unknown request type: 0x%02x", reqType))
+		return func(context.Context) func() error {
+			err := writeErr(conn, fmt.Sprintf("unknown request type: 0x%02x", reqType))
+			return func() error { return err }
+		}, true, false, nil
 	}
-
-	return false, nil
 }
@@ -0,0 +1,136 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright 2026 Joel Rosdahl
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+// fakeStreamStorage is a minimal storage implementation for exercising
+// respondGetStream's interaction with streamWriter.
+type fakeStreamStorage struct {
+	partial  []byte // written to w before getStream fails, if getErr != nil
+	getErr   error
+	getFound bool
+	value    []byte // written in full, then (bool, nil) returned, if getErr == nil
+}
+
+func (f *fakeStreamStorage) get(ctx context.Context, key []byte) ([]byte, bool, error) {
+	return nil, false, errors.New("not implemented")
+}
+func (f *fakeStreamStorage) put(ctx context.Context, key []byte, value []byte, overwrite bool) (bool, error) {
+	return false, errors.New("not implemented")
+}
+func (f *fakeStreamStorage) remove(ctx context.Context, key []byte) (bool, error) {
+	return false, errors.New("not implemented")
+}
+func (f *fakeStreamStorage) putStream(ctx context.Context, key []byte, r io.Reader, size uint64, overwrite bool) (bool, error) {
+	return false, errors.New("not implemented")
+}
+
+func (f *fakeStreamStorage) getStream(ctx context.Context, key []byte, w io.Writer) (bool, error) {
+	if f.getErr != nil {
+		if len(f.partial) > 0 {
+			if _, err := w.Write(f.partial); err != nil {
+				return false, err
+			}
+		}
+		return false, f.getErr
+	}
+	if _, err := w.Write(f.value); err != nil {
+		return false, err
+	}
+	return f.getFound, nil
+}
+
+// TestRespondGetStreamFailureAfterStartEndsChunkStreamCleanly covers a
+// backend failure that happens after the first chunk has already gone
+// out: respondGetStream must not write a second top-level response byte
+// into the middle of the chunk stream (which would desync the
+// connection), but instead terminate the chunk stream in a way the
+// peer's chunkReader can detect as a failure.
+func TestRespondGetStreamFailureAfterStartEndsChunkStreamCleanly(t *testing.T) {
+	backendErr := errors.New("backend exploded mid-transfer")
+	store := &fakeStreamStorage{partial: []byte("partial-data"), getErr: backendErr}
+
+	var buf bytes.Buffer
+	err := respondGetStream(context.Background(), &buf, store, newLogger(""), []byte("key"), 64*1024)
+	if err != nil {
+		t.Fatalf("respondGetStream: %v", err)
+	}
+
+	respType, err := readByte(&buf)
+	if err != nil || respType != responseOK {
+		t.Fatalf("response byte: got %v, err %v, want responseOK", respType, err)
+	}
+
+	cr := newChunkReader(&buf)
+	got := make([]byte, len("partial-data"))
+	if _, err := io.ReadFull(cr, got); err != nil {
+		t.Fatalf("reading partial chunk: %v", err)
+	}
+	if string(got) != "partial-data" {
+		t.Fatalf("partial chunk: got %q", got)
+	}
+
+	// The next Read must surface the failure, not a clean EOF (which would
+	// make a truncated stream indistinguishable from a short value) and
+	// not a bogus chunk length parsed out of a stray response byte.
+	n, err := cr.Read(make([]byte, 16))
+	if err == nil || err == io.EOF {
+		t.Fatalf("Read after failed stream: n=%d err=%v, want a non-EOF error", n, err)
+	}
+
+	// The connection must be left in sync: nothing should remain buffered
+	// that a subsequent request on the same connection would misread.
+	if buf.Len() != 0 {
+		t.Fatalf("%d stray bytes left on the connection after the failure", buf.Len())
+	}
+}
+
+func TestRespondGetStreamSuccessEndsWithZeroChunk(t *testing.T) {
+	store := &fakeStreamStorage{value: []byte("the value"), getFound: true}
+
+	var buf bytes.Buffer
+	if err := respondGetStream(context.Background(), &buf, store, newLogger(""), []byte("key"), 64*1024); err != nil {
+		t.Fatalf("respondGetStream: %v", err)
+	}
+
+	respType, err := readByte(&buf)
+	if err != nil || respType != responseOK {
+		t.Fatalf("response byte: got %v, err %v, want responseOK", respType, err)
+	}
+
+	cr := newChunkReader(&buf)
+	got, err := io.ReadAll(cr)
+	if err != nil {
+		t.Fatalf("reading value: %v", err)
+	}
+	if string(got) != "the value" {
+		t.Fatalf("value: got %q", got)
+	}
+}
+
+func TestRespondGetStreamFailureBeforeStartUsesTopLevelError(t *testing.T) {
+	backendErr := errors.New("backend unreachable")
+	store := &fakeStreamStorage{getErr: backendErr}
+
+	var buf bytes.Buffer
+	if err := respondGetStream(context.Background(), &buf, store, newLogger(""), []byte("key"), 64*1024); err != nil {
+		t.Fatalf("respondGetStream: %v", err)
+	}
+
+	respType, err := readByte(&buf)
+	if err != nil || respType != responseErr {
+		t.Fatalf("response byte: got %v, err %v, want responseErr", respType, err)
+	}
+	msg, err := readMsg(&buf)
+	if err != nil || msg != backendErr.Error() {
+		t.Fatalf("error message: got %q, err %v", msg, err)
+	}
+}
@@ -0,0 +1,104 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright 2026 Joel Rosdahl
+
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// retry calls attempt repeatedly until it reports success, a non-retryable
+// failure, or the retry budget is exhausted: maxAttempts additional tries
+// beyond the first, or CRSH_RETRY_MAX_ELAPSED total time, whichever comes
+// first. Between tries it waits for the delay attempt requested (e.g. from
+// a Retry-After header), or otherwise an exponential backoff with full
+// jitter (CRSH_RETRY_BASE_MS * 2^attemptNum, capped at CRSH_RETRY_MAX_MS).
+func (s *storageClient) retry(ctx context.Context, op string, maxAttempts int, attempt func(attemptNum int) (retryable bool, retryAfter time.Duration, err error)) error {
+	start := time.Now()
+	for attemptNum := 0; ; attemptNum++ {
+		retryable, retryAfter, err := attempt(attemptNum)
+		if err == nil {
+			return nil
+		}
+		if !retryable || attemptNum >= maxAttempts {
+			return err
+		}
+		if s.retryMaxElapsed > 0 && time.Since(start) >= s.retryMaxElapsed {
+			return err
+		}
+
+		delay := retryAfter
+		if delay <= 0 {
+			delay = backoffDelay(attemptNum, s.retryBaseDelay, s.retryMaxDelay)
+		}
+		s.logger.logf("%s: attempt %d failed, retrying in %s: %v", op, attemptNum+1, delay, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// backoffDelay returns a random delay in [0, backoff], where backoff is
+// base*2^attemptNum capped at max. Full jitter (rather than a fixed
+// backoff) avoids many clients retrying in lockstep after a shared
+// failure, e.g. a proxy restart.
+func backoffDelay(attemptNum int, base, max time.Duration) time.Duration {
+	backoff := base * time.Duration(int64(1)<<uint(attemptNum))
+	if backoff <= 0 || backoff > max {
+		backoff = max
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// classifyStatus reports whether an HTTP response status is worth
+// retrying, and the delay requested by a Retry-After header, if any.
+func classifyStatus(resp *http.Response) (retryable bool, retryAfter time.Duration) {
+	switch {
+	case resp.StatusCode == http.StatusRequestTimeout,
+		resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode >= 500:
+		return true, parseRetryAfter(resp)
+	default:
+		return false, 0
+	}
+}
+
+// isRetryableRequestError reports whether a client.Do error, i.e. a
+// network or transport-level failure, should be retried. Context
+// cancellation or deadline expiry (server shutdown, client disconnect) is
+// never retryable.
+func isRetryableRequestError(err error) bool {
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+func parseRetryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs <= 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
@@ -5,13 +5,13 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -19,29 +19,146 @@ type storageClient struct {
 	client      *http.Client
 	baseURL     *url.URL
 	layout      string
+	bazelKind   string
 	bearerToken string
 	headers     map[string]string
 	logger      *logger
-	mu          sync.Mutex
+
+	retries         int
+	retryBaseDelay  time.Duration
+	retryMaxDelay   time.Duration
+	retryMaxElapsed time.Duration
+
+	compression      string
+	compressionLevel int
 }
 
 func newStorageClient(cfg *config, logger *logger) (*storageClient, error) {
+	if cfg.TLSConfig != nil {
+		logger.logf("TLS: %s", describeTLS(cfg))
+	}
+	if cfg.Compression != "none" {
+		logger.logf("Compression: %s (level %d)", cfg.Compression, cfg.CompressionLevel)
+	}
+	if cfg.Layout == "bazel" && cfg.BazelKind == "cas" {
+		logger.logf("warning: bazel-kind=cas addresses get/remove by treating ccache's cache key as a content digest, which it isn't; entries this helper writes will generally not be found or removed again unless the caller independently supplies real SHA-256 content digests as keys")
+	}
+
 	client := &http.Client{
 		Timeout: 10 * time.Second,
 		Transport: &http.Transport{
 			MaxIdleConns:        100,
 			MaxIdleConnsPerHost: 10,
 			IdleConnTimeout:     90 * time.Second,
+			TLSClientConfig:     cfg.TLSConfig,
 		},
 	}
 
 	return &storageClient{
-		client:      client,
-		baseURL:     cfg.URL,
-		layout:      cfg.Layout,
-		bearerToken: cfg.BearerToken,
-		headers:     cfg.Headers,
-		logger:      logger,
+		client:          client,
+		baseURL:         cfg.URL,
+		layout:          cfg.Layout,
+		bazelKind:       cfg.BazelKind,
+		bearerToken:     cfg.BearerToken,
+		headers:         cfg.Headers,
+		logger:          logger,
+		retries:         cfg.Retries,
+		retryBaseDelay:  cfg.RetryBaseDelay,
+		retryMaxDelay:   cfg.RetryMaxDelay,
+		retryMaxElapsed: cfg.RetryMaxElapsed,
+
+		compression:      cfg.Compression,
+		compressionLevel: cfg.CompressionLevel,
+	}, nil
+}
+
+// compressValue compresses value according to s.compression, returning the
+// compressed bytes and the headers a PUT needs to set (value itself and nil
+// headers if compression is disabled). value is already fully buffered by the
+// caller, so compressing into a buffer here doesn't add an intermediate
+// copy of the whole artifact that wouldn't already exist.
+func (s *storageClient) compressValue(value []byte) ([]byte, map[string]string, error) {
+	if s.compression == "none" {
+		return value, nil, nil
+	}
+
+	var buf bytes.Buffer
+	cw, err := compressWriter(&buf, s.compression, s.compressionLevel)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := cw.Write(value); err != nil {
+		return nil, nil, err
+	}
+	if err := cw.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	return buf.Bytes(), map[string]string{
+		"Content-Encoding":     s.compression,
+		"X-CRSH-Original-Size": fmt.Sprintf("%d", len(value)),
+	}, nil
+}
+
+// compressStream wraps r so it yields r's content compressed according to
+// s.compression, without ever holding the whole artifact in memory: it
+// compresses into an io.Pipe on a background goroutine as the returned
+// reader is consumed. originalSize is reported via X-CRSH-Original-Size.
+// The compressed size isn't known ahead of time, so the caller should send
+// the request with Content-Length left unset (chunked transfer encoding).
+func (s *storageClient) compressStream(r io.Reader, originalSize uint64) (io.Reader, map[string]string) {
+	if s.compression == "none" {
+		return r, nil
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		cw, err := compressWriter(pw, s.compression, s.compressionLevel)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		_, copyErr := io.Copy(cw, r)
+		closeErr := cw.Close()
+		if copyErr == nil {
+			copyErr = closeErr
+		}
+		pw.CloseWithError(copyErr)
+	}()
+
+	return pr, map[string]string{
+		"Content-Encoding":     s.compression,
+		"X-CRSH-Original-Size": fmt.Sprintf("%d", originalSize),
+	}
+}
+
+// setCompressionRequestHeaders applies the headers returned by
+// compressValue/compressStream, and advertises Accept-Encoding so the
+// server can return a compressed body too; a server that doesn't support
+// it is expected to just ignore the header and return the value as-is.
+func (s *storageClient) setCompressionRequestHeaders(req *http.Request, encodingHeaders map[string]string) {
+	for k, v := range encodingHeaders {
+		req.Header.Set(k, v)
+	}
+	if s.compression != "none" {
+		req.Header.Set("Accept-Encoding", acceptEncoding(s.compression))
+	}
+}
+
+// decompressBody wraps resp.Body according to its Content-Encoding
+// header, if any, and returns a combined closer that releases both the
+// decompressor (if any) and the response body itself.
+func decompressBody(resp *http.Response) (io.Reader, func() error, error) {
+	body, closer, err := decompressReader(resp.Body, resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, err
+	}
+	return body, func() error {
+		if closer != nil {
+			closer.Close()
+		}
+		return resp.Body.Close()
 	}, nil
 }
 
@@ -52,8 +169,12 @@ func (s *storageClient) keyToPath(key []byte) string {
 	case "flat":
 		return keyHex
 
-	case "bazel":
-		// Bazel format: ac/ + 64 hex digits, so pad shorter keys by repeating the key prefix to reach the expected SHA256 size.
+	case "bazel-legacy":
+		// Earlier bazel layout: ac/ + 64 hex digits, padding shorter keys by
+		// repeating the key prefix to reach the expected SHA-256 size. This
+		// does not produce valid REAPI digests; kept only for deployments
+		// pinned to paths written by that layout. New deployments should use
+		// "bazel" instead, which computes a real digest (see bazel.go).
 		const sha256HexSize = 64
 		if len(keyHex) >= sha256HexSize {
 			return fmt.Sprintf("ac/%s", keyHex[:sha256HexSize])
@@ -69,8 +190,11 @@ func (s *storageClient) keyToPath(key []byte) string {
 }
 
 func (s *storageClient) buildURL(key []byte) (string, error) {
+	return s.buildURLForPath(s.keyToPath(key))
+}
+
+func (s *storageClient) buildURLForPath(path string) (string, error) {
 	base := *s.baseURL // Copy to avoid modifying the original
-	path := s.keyToPath(key)
 	if strings.HasSuffix(base.Path, "/") {
 		base.Path = base.Path + path
 	} else if base.Path == "" {
@@ -82,48 +206,74 @@ func (s *storageClient) buildURL(key []byte) (string, error) {
 	return base.String(), nil
 }
 
-func (s *storageClient) get(key []byte) ([]byte, bool, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// get, put, remove, getStream and putStream are safe to call concurrently:
+// the underlying http.Client is safe for concurrent use, and ctx lets a
+// caller cancel an individual in-flight request (e.g. on client disconnect
+// or server shutdown) without affecting any other.
 
-	urlStr, err := s.buildURL(key)
-	if err != nil {
-		return nil, false, err
+func (s *storageClient) get(ctx context.Context, key []byte) ([]byte, bool, error) {
+	if s.layout == "bazel" {
+		return s.bazelGet(ctx, key)
 	}
 
-	s.logger.logf("GET %s", urlStr)
-	req, err := http.NewRequest("GET", urlStr, nil)
+	urlStr, err := s.buildURL(key)
 	if err != nil {
 		return nil, false, err
 	}
 
-	s.addHeaders(req)
+	var value []byte
+	var found bool
+	err = s.retry(ctx, "GET", s.retries, func(attemptNum int) (bool, time.Duration, error) {
+		s.logger.logf("GET %s", urlStr)
+		req, err := http.NewRequestWithContext(ctx, "GET", urlStr, nil)
+		if err != nil {
+			return false, 0, err
+		}
 
-	resp, err := s.client.Do(req)
-	if err != nil {
-		return nil, false, err
-	}
-	defer resp.Body.Close()
+		s.addHeaders(req)
+		if s.compression != "none" {
+			req.Header.Set("Accept-Encoding", acceptEncoding(s.compression))
+		}
 
-	if resp.StatusCode == http.StatusNotFound {
-		return nil, false, nil
-	}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return isRetryableRequestError(err), 0, err
+		}
+		defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, false, fmt.Errorf("HTTP %d", resp.StatusCode)
-	}
+		if resp.StatusCode == http.StatusNotFound {
+			io.Copy(io.Discard, resp.Body) // Read and discard to enable connection reuse
+			found = false
+			return false, 0, nil
+		}
 
-	value, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, false, err
-	}
+		if resp.StatusCode != http.StatusOK {
+			retryable, retryAfter := classifyStatus(resp)
+			io.Copy(io.Discard, resp.Body) // Read and discard to enable connection reuse
+			return retryable, retryAfter, fmt.Errorf("HTTP %d", resp.StatusCode)
+		}
 
-	return value, true, nil
+		body, closeBody, err := decompressBody(resp)
+		if err != nil {
+			return false, 0, err
+		}
+		defer closeBody()
+
+		v, err := io.ReadAll(body)
+		if err != nil {
+			return true, 0, err // a GET can always be safely retried
+		}
+		value, found = v, true
+		return false, 0, nil
+	})
+
+	return value, found, err
 }
 
-func (s *storageClient) put(key []byte, value []byte, overwrite bool) (bool, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *storageClient) put(ctx context.Context, key []byte, value []byte, overwrite bool) (bool, error) {
+	if s.layout == "bazel" {
+		return s.bazelPut(ctx, key, value, overwrite)
+	}
 
 	urlStr, err := s.buildURL(key)
 	if err != nil {
@@ -131,7 +281,7 @@ func (s *storageClient) put(key []byte, value []byte, overwrite bool) (bool, err
 	}
 
 	if !overwrite {
-		exists, err := s.exists(urlStr)
+		exists, err := s.exists(ctx, urlStr)
 		if err != nil {
 			return false, err
 		}
@@ -140,83 +290,273 @@ func (s *storageClient) put(key []byte, value []byte, overwrite bool) (bool, err
 		}
 	}
 
-	s.logger.logf("PUT %s (%d bytes)", urlStr, len(value))
-	req, err := http.NewRequest("PUT", urlStr, bytes.NewReader(value))
+	body, encodingHeaders, err := s.compressValue(value)
 	if err != nil {
 		return false, err
 	}
 
-	s.addHeaders(req)
-	req.Header.Set("Content-Type", "application/octet-stream")
+	var stored bool
+	err = s.retry(ctx, "PUT", s.retries, func(attemptNum int) (bool, time.Duration, error) {
+		s.logger.logf("PUT %s (%d bytes, %d on the wire)", urlStr, len(value), len(body))
+		req, err := http.NewRequestWithContext(ctx, "PUT", urlStr, bytes.NewReader(body))
+		if err != nil {
+			return false, 0, err
+		}
+
+		s.addHeaders(req)
+		req.Header.Set("Content-Type", "application/octet-stream")
+		s.setCompressionRequestHeaders(req, encodingHeaders)
 
-	resp, err := s.client.Do(req)
-	if err != nil {
-		return false, err
-	}
-	defer resp.Body.Close()
+		resp, err := s.client.Do(req)
+		if err != nil {
+			// body is fully buffered, so resending it on retry is safe
+			// regardless of how much of it the server already received.
+			return isRetryableRequestError(err), 0, err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body) // Read and discard to enable connection reuse
 
-	io.Copy(io.Discard, resp.Body) // Read and discard to enable connection reuse
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			stored = true
+			return false, 0, nil
+		}
 
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		return true, nil
-	}
+		retryable, retryAfter := classifyStatus(resp)
+		return retryable, retryAfter, fmt.Errorf("HTTP %d", resp.StatusCode)
+	})
 
-	return false, fmt.Errorf("HTTP %d", resp.StatusCode)
+	return stored, err
 }
 
-func (s *storageClient) remove(key []byte) (bool, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *storageClient) remove(ctx context.Context, key []byte) (bool, error) {
+	if s.layout == "bazel" {
+		return s.bazelRemove(ctx, key)
+	}
 
 	urlStr, err := s.buildURL(key)
 	if err != nil {
 		return false, err
 	}
 
-	s.logger.logf("DELETE %s", urlStr)
-	req, err := http.NewRequest("DELETE", urlStr, nil)
+	var removed bool
+	err = s.retry(ctx, "DELETE", s.retries, func(attemptNum int) (bool, time.Duration, error) {
+		s.logger.logf("DELETE %s", urlStr)
+		req, err := http.NewRequestWithContext(ctx, "DELETE", urlStr, nil)
+		if err != nil {
+			return false, 0, err
+		}
+
+		s.addHeaders(req)
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return isRetryableRequestError(err), 0, err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body) // Read and discard to enable connection reuse
+
+		if resp.StatusCode == http.StatusNotFound {
+			removed = false
+			return false, 0, nil
+		}
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			removed = true
+			return false, 0, nil
+		}
+
+		retryable, retryAfter := classifyStatus(resp)
+		return retryable, retryAfter, fmt.Errorf("HTTP %d", resp.StatusCode)
+	})
+
+	return removed, err
+}
+
+// getStream behaves like get, but copies the value directly from the HTTP
+// response body into w instead of buffering it, so the caller never holds
+// the whole value in memory. Only the request/status phase is retried: once
+// bytes have started flowing into w there is no way to retry without
+// sending the peer a duplicate or inconsistent stream.
+func (s *storageClient) getStream(ctx context.Context, key []byte, w io.Writer) (bool, error) {
+	if s.layout == "bazel" {
+		return s.bazelGetStream(ctx, key, w)
+	}
+
+	urlStr, err := s.buildURL(key)
 	if err != nil {
 		return false, err
 	}
 
-	s.addHeaders(req)
+	var resp *http.Response
+	var found bool
+	err = s.retry(ctx, "GET (stream)", s.retries, func(attemptNum int) (bool, time.Duration, error) {
+		s.logger.logf("GET (stream) %s", urlStr)
+		req, err := http.NewRequestWithContext(ctx, "GET", urlStr, nil)
+		if err != nil {
+			return false, 0, err
+		}
 
-	resp, err := s.client.Do(req)
-	if err != nil {
+		s.addHeaders(req)
+		if s.compression != "none" {
+			req.Header.Set("Accept-Encoding", acceptEncoding(s.compression))
+		}
+
+		r, err := s.client.Do(req)
+		if err != nil {
+			return isRetryableRequestError(err), 0, err
+		}
+
+		if r.StatusCode == http.StatusNotFound {
+			io.Copy(io.Discard, r.Body) // Read and discard to enable connection reuse
+			r.Body.Close()
+			found = false
+			return false, 0, nil
+		}
+
+		if r.StatusCode != http.StatusOK {
+			retryable, retryAfter := classifyStatus(r)
+			io.Copy(io.Discard, r.Body) // Read and discard to enable connection reuse
+			r.Body.Close()
+			return retryable, retryAfter, fmt.Errorf("HTTP %d", r.StatusCode)
+		}
+
+		resp, found = r, true
+		return false, 0, nil
+	})
+	if err != nil || !found {
 		return false, err
 	}
-	defer resp.Body.Close()
-
-	io.Copy(io.Discard, resp.Body) // Read and discard to enable connection reuse
 
-	if resp.StatusCode == http.StatusNotFound {
-		return false, nil
+	body, closeBody, err := decompressBody(resp)
+	if err != nil {
+		return false, err
 	}
+	defer closeBody()
 
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		return true, nil
+	if _, err := io.Copy(w, body); err != nil {
+		return false, err
 	}
 
-	return false, fmt.Errorf("HTTP %d", resp.StatusCode)
+	return true, nil
 }
 
-func (s *storageClient) exists(urlStr string) (bool, error) {
-	req, err := http.NewRequest("HEAD", urlStr, nil)
+// putStream behaves like put, but reads the value directly from r as it is
+// sent to the HTTP request body instead of buffering it first. size is the
+// exact number of bytes r will yield; it is used as the request's
+// Content-Length when compression is disabled, and otherwise sent as
+// X-CRSH-Original-Size with the compressed body chunked. Retries require r to be an io.ReadSeeker so its start can
+// be rewound; with an unseekable source (e.g. a value streamed straight off
+// the IPC connection), the request is attempted only once.
+func (s *storageClient) putStream(ctx context.Context, key []byte, r io.Reader, size uint64, overwrite bool) (bool, error) {
+	if s.layout == "bazel" {
+		return s.bazelPutStream(ctx, key, r, size, overwrite)
+	}
+
+	urlStr, err := s.buildURL(key)
 	if err != nil {
 		return false, err
 	}
 
-	s.addHeaders(req)
+	if !overwrite {
+		exists, err := s.exists(ctx, urlStr)
+		if err != nil {
+			return false, err
+		}
+		if exists {
+			return false, nil
+		}
+	}
 
-	resp, err := s.client.Do(req)
-	if err != nil {
-		return false, err
+	seeker, seekable := r.(io.ReadSeeker)
+	maxAttempts := s.retries
+	if !seekable {
+		maxAttempts = 0
 	}
-	defer resp.Body.Close()
 
-	io.Copy(io.Discard, resp.Body) // Read and discard to enable connection reuse
+	var stored bool
+	err = s.retry(ctx, "PUT (stream)", maxAttempts, func(attemptNum int) (bool, time.Duration, error) {
+		if attemptNum > 0 {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return false, 0, err
+			}
+		}
+
+		s.logger.logf("PUT (stream) %s (%d bytes)", urlStr, size)
+		body, encodingHeaders := s.compressStream(r, size)
+		// For compression != "none", body is the *io.PipeReader side of
+		// compressStream's pipe, and must be passed through as-is (not
+		// wrapped in io.NopCloser): NewRequestWithContext needs its real
+		// Close to unblock the pipe's writer goroutine if the request
+		// fails before the body is fully read. For "none", body is r
+		// itself, which the caller owns and may Seek and reuse across
+		// retries, so it's wrapped in io.NopCloser as usual to keep the
+		// transport from closing it out from under a retry.
+		requestBody := io.ReadCloser(io.NopCloser(body))
+		if s.compression != "none" {
+			requestBody = body.(io.ReadCloser)
+		}
+		req, err := http.NewRequestWithContext(ctx, "PUT", urlStr, requestBody)
+		if err != nil {
+			return false, 0, err
+		}
+		if s.compression == "none" {
+			req.ContentLength = int64(size) // exact size known; avoids chunked encoding
+		}
+
+		s.addHeaders(req)
+		req.Header.Set("Content-Type", "application/octet-stream")
+		s.setCompressionRequestHeaders(req, encodingHeaders)
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return isRetryableRequestError(err), 0, err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body) // Read and discard to enable connection reuse
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			stored = true
+			return false, 0, nil
+		}
+
+		retryable, retryAfter := classifyStatus(resp)
+		return retryable, retryAfter, fmt.Errorf("HTTP %d", resp.StatusCode)
+	})
+
+	return stored, err
+}
+
+func (s *storageClient) exists(ctx context.Context, urlStr string) (bool, error) {
+	var exists bool
+	err := s.retry(ctx, "HEAD", s.retries, func(attemptNum int) (bool, time.Duration, error) {
+		req, err := http.NewRequestWithContext(ctx, "HEAD", urlStr, nil)
+		if err != nil {
+			return false, 0, err
+		}
+
+		s.addHeaders(req)
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return isRetryableRequestError(err), 0, err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body) // Read and discard to enable connection reuse
+
+		if resp.StatusCode == http.StatusOK {
+			exists = true
+			return false, 0, nil
+		}
+
+		if retryable, retryAfter := classifyStatus(resp); retryable {
+			return true, retryAfter, fmt.Errorf("HTTP %d", resp.StatusCode)
+		}
+
+		exists = false
+		return false, 0, nil
+	})
 
-	return resp.StatusCode == http.StatusOK, nil
+	return exists, err
 }
 
 func (s *storageClient) addHeaders(req *http.Request) {
@@ -0,0 +1,131 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright 2026 Joel Rosdahl
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestPutStreamCompressedFailureDoesNotLeakGoroutine guards against a
+// regression of the bug where wrapping compressStream's io.Pipe reader in
+// io.NopCloser discarded its Close method, leaving compressStream's
+// background compression goroutine blocked forever on a PUT that fails
+// before the request body is ever read (e.g. a connection refused).
+func TestPutStreamCompressedFailureDoesNotLeakGoroutine(t *testing.T) {
+	// A listener that's immediately closed gives a loopback address where
+	// connections are refused, without depending on any specific unused
+	// port being free.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	u, err := url.Parse("http://" + addr + "/cache")
+	if err != nil {
+		t.Fatalf("parse URL: %v", err)
+	}
+
+	c := &storageClient{
+		client:      http.DefaultClient,
+		baseURL:     u,
+		layout:      "subdirs",
+		logger:      newLogger(""),
+		retries:     0,
+		compression: "zstd",
+	}
+
+	before := runtime.NumGoroutine()
+
+	value := bytes.Repeat([]byte("x"), 4096)
+	_, err = c.putStream(context.Background(), []byte{0xaa}, bytes.NewReader(value), uint64(len(value)), true)
+	if err == nil {
+		t.Fatalf("expected putStream against a refused connection to fail")
+	}
+
+	// Give the (hopefully absent) leaked goroutine a moment it would need
+	// to still be blocked in, and the real, short-lived ones spawned by
+	// net/http a moment to exit.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("goroutine count grew from %d to %d after a failed compressed PUT", before, after)
+	}
+}
+
+// closeTrackingReadSeeker wraps a bytes.Reader with an io.Closer, to stand
+// in for a caller-owned seekable value source (e.g. an *os.File) that
+// putStream must be able to Seek back to the start of and reuse across
+// retries.
+type closeTrackingReadSeeker struct {
+	*bytes.Reader
+	closeCalls int32
+}
+
+func (c *closeTrackingReadSeeker) Close() error {
+	atomic.AddInt32(&c.closeCalls, 1)
+	return nil
+}
+
+// TestPutStreamUncompressedRetryDoesNotCloseCallerReader guards against a
+// regression where skipping io.NopCloser unconditionally (rather than only
+// for compressStream's own pipe reader) let the HTTP transport close a
+// caller-owned, closer-implementing body on an attempt that gets retried,
+// which would break the next attempt's Seek.
+func TestPutStreamUncompressedRetryDoesNotCloseCallerReader(t *testing.T) {
+	var requestNum int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if atomic.AddInt32(&requestNum, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL + "/cache")
+	if err != nil {
+		t.Fatalf("parse URL: %v", err)
+	}
+
+	c := &storageClient{
+		client:         http.DefaultClient,
+		baseURL:        u,
+		layout:         "subdirs",
+		logger:         newLogger(""),
+		retries:        1,
+		retryBaseDelay: time.Millisecond,
+		retryMaxDelay:  time.Millisecond,
+		compression:    "none",
+	}
+
+	value := []byte("retry me")
+	r := &closeTrackingReadSeeker{Reader: bytes.NewReader(value)}
+
+	stored, err := c.putStream(context.Background(), []byte{0xbb}, r, uint64(len(value)), true)
+	if err != nil || !stored {
+		t.Fatalf("putStream: stored=%v err=%v", stored, err)
+	}
+	if atomic.LoadInt32(&requestNum) != 2 {
+		t.Fatalf("expected 2 attempts (1 failure + 1 success), got %d", requestNum)
+	}
+	if calls := atomic.LoadInt32(&r.closeCalls); calls != 0 {
+		t.Fatalf("caller's reader was Closed %d times; the transport must only close the request's own NopCloser wrapper", calls)
+	}
+}
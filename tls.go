@@ -0,0 +1,62 @@
+// SPDX-License-Identifier: BSD-3-Clause
+// Copyright 2026 Joel Rosdahl
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// buildTLSConfig builds the *tls.Config for the HTTP backend from the
+// ca-cert, client-cert, client-key, tls-insecure-skip-verify and
+// tls-server-name CRSH_ATTR keys in cfg. It returns nil if none of them
+// were set, so newStorageClient falls back to the transport's default TLS
+// config. Certificate and key files are loaded eagerly so that a missing
+// or unparseable file fails parseConfig instead of the first request.
+func buildTLSConfig(cfg *config) (*tls.Config, error) {
+	if cfg.CACertFile == "" && cfg.ClientCertFile == "" && cfg.ClientKeyFile == "" &&
+		!cfg.TLSInsecureSkipVerify && cfg.TLSServerName == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.TLSInsecureSkipVerify,
+		ServerName:         cfg.TLSServerName,
+	}
+
+	if cfg.CACertFile != "" {
+		pem, err := os.ReadFile(cfg.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca-cert %q: %w", cfg.CACertFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca-cert %q contains no usable certificates", cfg.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.ClientCertFile != "" || cfg.ClientKeyFile != "" {
+		if cfg.ClientCertFile == "" || cfg.ClientKeyFile == "" {
+			return nil, fmt.Errorf("client-cert and client-key attributes must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCertFile, cfg.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client-cert/client-key: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// describeTLS summarizes which TLS features are active, for logging at
+// startup. It never includes file contents or key material.
+func describeTLS(cfg *config) string {
+	return fmt.Sprintf(
+		"ca-cert=%t client-cert=%t insecure-skip-verify=%t server-name=%q",
+		cfg.CACertFile != "", cfg.ClientCertFile != "", cfg.TLSInsecureSkipVerify, cfg.TLSServerName)
+}